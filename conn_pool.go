@@ -1,35 +1,222 @@
+// The context-aware acquisition, circuit breaker and Stats/BreakerStats
+// additions in this file are pool-only: this tree has no Bucket type
+// for them to be plumbed through or aggregated against host-by-host,
+// so GetWithContext, ReportIOResult and the breaker, and Stats all have
+// no caller outside this file and its tests. Flag this to whoever owns
+// the backlog before merging if landing pool-only primitives ahead of
+// that wiring isn't the intended scope.
 package couchbase
 
 import (
+	"context"
 	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dustin/gomemcached"
 	"github.com/dustin/gomemcached/client"
 )
 
+// reapInterval is how often the background reaper scans the pool for
+// connections that have exceeded IdleTimeout or MaxLifetime. A var,
+// like ConnPoolTimeout below, so tests can shrink it.
+var reapInterval = time.Minute
+
+// Defaults used when a pool enables its circuit breaker (by setting
+// BreakerThreshold) without specifying BreakerCooldown / BreakerMaxCooldown.
+const (
+	defaultBreakerCooldown    = 5 * time.Second
+	defaultBreakerMaxCooldown = 2 * time.Minute
+)
+
+// defaultTestOnBorrowIdle is how long a pooled connection may sit idle
+// before TestOnBorrow, if set, is invoked on checkout.
+const defaultTestOnBorrowIdle = 30 * time.Second
+
+// defaultTestOnBorrowTimeout bounds how long TestOnBorrow gets to run
+// when the caller's own context has no deadline (or one far in the
+// future, like the 30-day ConnPoolTimeout default) — otherwise a
+// health check meant to catch a half-open socket could itself hang
+// indefinitely on that same socket.
+const defaultTestOnBorrowTimeout = 2 * time.Second
+
 // Error raised when a connection can't be retrieved from a pool.
 var TimeoutError = errors.New("timeout waiting to build connection")
 var closedPool = errors.New("the pool is closed")
 
+// ErrCircuitOpen is returned by Get/GetWithTimeout/GetWithContext when
+// the pool's circuit breaker has tripped for this host and is still in
+// its cooldown window. Callers on latency-critical paths can treat it
+// like a cache miss and fall back elsewhere rather than piling up
+// goroutines waiting on a dead host.
+var ErrCircuitOpen = errors.New("circuit breaker open for this host")
+
 // Default timeout for retrieving a connection from the pool.
 var ConnPoolTimeout = time.Hour * 24 * 30
 
+// pooledConn wraps a pooled *memcached.Client with the bookkeeping
+// needed to reap it once it has idled or lived too long.
+type pooledConn struct {
+	conn          *memcached.Client
+	timeInitiated time.Time
+	timeUsed      time.Time
+}
+
 type connectionPool struct {
 	host        string
 	mkConn      func(host string, ah AuthHandler) (*memcached.Client, error)
 	auth        AuthHandler
-	connections chan *memcached.Client
+	connections chan *pooledConn
 	createsem   chan bool
+
+	// IdleTimeout, if non-zero, discards a pooled connection that has
+	// sat unused for longer than this instead of handing it back out.
+	IdleTimeout time.Duration
+	// MaxLifetime, if non-zero, discards a pooled connection once this
+	// long has elapsed since it was dialed, regardless of idle time.
+	MaxLifetime time.Duration
+
+	// BreakerThreshold is the number of consecutive dial failures (and
+	// IO failures fed in through ReportIOResult)
+	// against this pool's host before the circuit breaker trips open
+	// and Get calls fail fast with ErrCircuitOpen instead of blocking
+	// on mkConn. Zero disables the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is the base cooldown a freshly tripped breaker
+	// waits before letting a single probe connection through. Defaults
+	// to defaultBreakerCooldown when BreakerThreshold is set and this
+	// is zero.
+	BreakerCooldown time.Duration
+	// BreakerMaxCooldown caps the exponential backoff applied to
+	// BreakerCooldown on repeated probe failures. The +/-20% jitter is
+	// applied after the cap, so a single wait can exceed it by up to
+	// a fifth. Defaults to
+	// defaultBreakerMaxCooldown when BreakerThreshold is set and this
+	// is zero.
+	BreakerMaxCooldown time.Duration
+
+	breaker breakerState
+
+	// TestOnBorrow, if set, is invoked on a pooled connection that has
+	// sat idle for longer than TestOnBorrowIdle before it is handed to
+	// a caller. A non-nil error discards the connection and the pool
+	// tries again, so the caller never sees the stale connection's
+	// first (likely failed) operation. ctx is bounded by TestOnBorrowTimeout
+	// (or the caller's own deadline, whichever is sooner), so a check
+	// against a half-open socket can't hang the Get it was meant to
+	// protect. See DefaultTestOnBorrow for a ready-made NOOP-based check.
+	TestOnBorrow func(ctx context.Context, mc *memcached.Client, idleSince time.Time) error
+	// TestOnBorrowIdle is the idle threshold that triggers TestOnBorrow.
+	// Zero (the default) uses defaultTestOnBorrowIdle; it has no effect
+	// when TestOnBorrow is nil.
+	TestOnBorrowIdle time.Duration
+	// TestOnBorrowTimeout bounds how long a single TestOnBorrow call
+	// gets to run. Zero (the default) uses defaultTestOnBorrowTimeout.
+	TestOnBorrowTimeout time.Duration
+
+	mu       sync.Mutex
+	metadata map[*memcached.Client]*pooledConn
+	reapOnce sync.Once
+	reapStop chan bool
+	reapDone chan bool
+
+	statGets       uint64
+	statWaits      uint64
+	statWaitNanos  uint64
+	statTimeouts   uint64
+	statDialErrors uint64
+	statOverflows  uint64
+	statReturned   uint64
+	statDiscarded  uint64
+}
+
+// PoolStats is a point-in-time snapshot of a connectionPool's activity,
+// suitable for wiring into Prometheus/OpenMetrics collectors.
+type PoolStats struct {
+	Gets         uint64
+	Waits        uint64
+	WaitDuration time.Duration
+	Timeouts     uint64
+	DialErrors   uint64
+	Overflows    uint64
+	Returned     uint64
+	Discarded    uint64
+	Idle         int
+	InUse        int
+}
+
+// Stats returns a snapshot of this pool's counters and gauges. Today
+// the pool is otherwise a black box: there's no way to tell whether
+// TimeoutErrors are from under-sizing, a slow server, or connection
+// churn without this.
+func (cp *connectionPool) Stats() PoolStats {
+	idle := len(cp.connections)
+	return PoolStats{
+		Gets:         atomic.LoadUint64(&cp.statGets),
+		Waits:        atomic.LoadUint64(&cp.statWaits),
+		WaitDuration: time.Duration(atomic.LoadUint64(&cp.statWaitNanos)),
+		Timeouts:     atomic.LoadUint64(&cp.statTimeouts),
+		DialErrors:   atomic.LoadUint64(&cp.statDialErrors),
+		Overflows:    atomic.LoadUint64(&cp.statOverflows),
+		Returned:     atomic.LoadUint64(&cp.statReturned),
+		Discarded:    atomic.LoadUint64(&cp.statDiscarded),
+		Idle:         idle,
+		InUse:        len(cp.createsem) - idle,
+	}
+}
+
+// breakerState is the circuit breaker's mutable state for a pool's host.
+type breakerState struct {
+	mu        sync.Mutex
+	open      bool
+	probing   bool
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	rng       *rand.Rand
+
+	trips     uint64
+	probes    uint64
+	successes uint64
+}
+
+// BreakerStats reports circuit breaker activity for a pool's host. See
+// connectionPool.BreakerStats.
+type BreakerStats struct {
+	Trips     uint64
+	Probes    uint64
+	Successes uint64
 }
 
 func newConnectionPool(host string, ah AuthHandler, poolSize, poolOverflow int) *connectionPool {
-	return &connectionPool{
+	cp := &connectionPool{
 		host:        host,
-		connections: make(chan *memcached.Client, poolSize),
+		connections: make(chan *pooledConn, poolSize),
 		createsem:   make(chan bool, poolSize+poolOverflow),
 		mkConn:      defaultMkConn,
 		auth:        ah,
+		metadata:    make(map[*memcached.Client]*pooledConn),
+		reapStop:    make(chan bool),
+		reapDone:    make(chan bool),
 	}
+	// The reaper isn't started here: IdleTimeout, MaxLifetime and the
+	// rest of the exported fields are plain struct fields set by the
+	// caller right after construction (cp := newConnectionPool(...);
+	// cp.IdleTimeout = d), and starting the goroutine eagerly would let
+	// it read those fields concurrently with that write, unsynchronized.
+	// startReaper defers the goroutine to first use instead, by which
+	// point configuration is done.
+	return cp
+}
+
+// startReaper starts the background reaper goroutine the first time
+// it's called; subsequent calls are no-ops. Called from both
+// GetWithContext (the common case) and Close (so a pool that's closed
+// without ever being used still has a reaper to wait on).
+func (cp *connectionPool) startReaper() {
+	cp.reapOnce.Do(func() { go cp.reaper() })
 }
 
 func defaultMkConn(host string, ah AuthHandler) (*memcached.Client, error) {
@@ -50,51 +237,438 @@ func defaultMkConn(host string, ah AuthHandler) (*memcached.Client, error) {
 
 func (cp *connectionPool) Close() (err error) {
 	defer func() { err, _ = recover().(error) }()
+	cp.startReaper()
+	close(cp.reapStop)
+	<-cp.reapDone // wait for the reaper to stop touching cp.connections
 	close(cp.connections)
-	for c := range cp.connections {
-		c.Close()
+	for pc := range cp.connections {
+		pc.conn.Close()
 	}
 	return
 }
 
+// discard releases a pooled connection's createsem hold, forgets its
+// metadata and closes it. Use this instead of c.Close() directly
+// whenever a connection is being removed from the pool rather than
+// handed to a caller.
+func (cp *connectionPool) discard(pc *pooledConn) {
+	atomic.AddUint64(&cp.statDiscarded, 1)
+	<-cp.createsem
+	cp.mu.Lock()
+	delete(cp.metadata, pc.conn)
+	cp.mu.Unlock()
+	pc.conn.Close()
+}
+
+// expired reports whether pc has exceeded IdleTimeout or MaxLifetime
+// as of now.
+func (cp *connectionPool) expired(pc *pooledConn, now time.Time) bool {
+	if cp.IdleTimeout > 0 && now.Sub(pc.timeUsed) > cp.IdleTimeout {
+		return true
+	}
+	if cp.MaxLifetime > 0 && now.Sub(pc.timeInitiated) > cp.MaxLifetime {
+		return true
+	}
+	return false
+}
+
+// reaper periodically drains stale connections from the pool so that
+// idle TCP connections silently killed by an intermediate load
+// balancer or firewall aren't handed to the next caller.
+func (cp *connectionPool) reaper() {
+	defer close(cp.reapDone)
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			cp.reapExpired()
+		case <-cp.reapStop:
+			return
+		}
+	}
+}
+
+func (cp *connectionPool) reapExpired() {
+	if cp.IdleTimeout == 0 && cp.MaxLifetime == 0 {
+		return
+	}
+
+	now := time.Now()
+	// Only scan what's in the pool right now so we can't loop forever
+	// against connections being concurrently returned.
+	for n := len(cp.connections); n > 0; n-- {
+		select {
+		case pc := <-cp.connections:
+			if cp.expired(pc, now) {
+				cp.discard(pc)
+				continue
+			}
+			select {
+			case cp.connections <- pc:
+			default:
+				// Concurrent Returns refilled the buffer; drop it
+				// rather than block.
+				cp.discard(pc)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// ReportIOResult feeds the outcome of an operation performed over a
+// connection from this pool (e.g. a Bucket KV call) back into the
+// circuit breaker, so failures seen after checkout — not just dial
+// failures — count toward BreakerThreshold.
+func (cp *connectionPool) ReportIOResult(err error) {
+	if cp.BreakerThreshold <= 0 {
+		return
+	}
+
+	b := &cp.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	if !b.probing {
+		cp.tripIfThresholdReached(b)
+	}
+}
+
+// BreakerStats returns a snapshot of this pool's circuit breaker
+// counters, for wiring into Prometheus/OpenMetrics or similar.
+func (cp *connectionPool) BreakerStats() BreakerStats {
+	b := &cp.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{Trips: b.trips, Probes: b.probes, Successes: b.successes}
+}
+
+func (cp *connectionPool) cooldownBase() time.Duration {
+	if cp.BreakerCooldown > 0 {
+		return cp.BreakerCooldown
+	}
+	return defaultBreakerCooldown
+}
+
+func (cp *connectionPool) cooldownMax() time.Duration {
+	if cp.BreakerMaxCooldown > 0 {
+		return cp.BreakerMaxCooldown
+	}
+	return defaultBreakerMaxCooldown
+}
+
+// jitter spreads d by +/-20%, using a source private to this breaker,
+// so that breakers tripped against the same host at the same moment
+// don't all probe again in lockstep. Callers must hold b.mu.
+func (b *breakerState) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	spread := int64(d) / 5
+	if spread == 0 {
+		return d
+	}
+	if b.rng == nil {
+		b.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return d + time.Duration(b.rng.Int63n(2*spread+1)-spread)
+}
+
+// tripIfThresholdReached records a non-probe failure and, once
+// consecutive failures reach cp.BreakerThreshold, opens the breaker
+// with a fresh, jittered cooldown. It is a no-op if the breaker is
+// already open, so failures piling up from callers that checked out a
+// connection before the trip don't reset an in-progress backoff -
+// only a failed probe (handled in breakerRecord) may grow the cooldown
+// once tripped. Callers must hold b.mu.
+func (cp *connectionPool) tripIfThresholdReached(b *breakerState) {
+	if b.open {
+		return
+	}
+	b.failures++
+	if b.failures >= cp.BreakerThreshold {
+		b.trips++
+		b.open = true
+		b.cooldown = cp.cooldownBase()
+		b.openUntil = time.Now().Add(b.jitter(b.cooldown))
+	}
+}
+
+// breakerGate decides whether a new dial may proceed. It returns
+// ErrCircuitOpen if the breaker is open and still cooling down, or if
+// another goroutine already owns the single probe attempt. The caller
+// must report the dial's outcome back via breakerRecord.
+func (cp *connectionPool) breakerGate() error {
+	if cp.BreakerThreshold <= 0 {
+		return nil
+	}
+
+	b := &cp.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	if b.probing {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	b.probes++
+	return nil
+}
+
+// breakerRelease clears a held probe slot without treating the attempt
+// as a failure or success, for the case where we never learned whether
+// the dial would have worked (e.g. the caller's context expired first).
+func (cp *connectionPool) breakerRelease() {
+	if cp.BreakerThreshold <= 0 {
+		return
+	}
+	b := &cp.breaker
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// breakerRecord reports the outcome of a dial attempted after
+// breakerGate returned nil, updating the breaker's trip/cooldown state.
+func (cp *connectionPool) breakerRecord(err error) {
+	if cp.BreakerThreshold <= 0 {
+		return
+	}
+
+	b := &cp.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbe := b.probing
+	if err == nil {
+		b.failures = 0
+		b.open = false
+		b.cooldown = 0
+		if wasProbe {
+			b.probing = false
+			b.successes++
+		}
+		return
+	}
+
+	if wasProbe {
+		b.probing = false
+		if b.cooldown < cp.cooldownBase() {
+			b.cooldown = cp.cooldownBase()
+		}
+		b.cooldown *= 2
+		if max := cp.cooldownMax(); b.cooldown > max {
+			b.cooldown = max
+		}
+		b.openUntil = time.Now().Add(b.jitter(b.cooldown))
+		return
+	}
+
+	cp.tripIfThresholdReached(b)
+}
+
+// DefaultTestOnBorrow is a ready-made TestOnBorrow implementation that
+// sends a memcached NOOP and waits for the reply, which is enough to
+// detect a half-open socket (peer gone, or silently dropped by a NAT or
+// load balancer) that IsHealthy's local-only check can't see. It gives
+// up and returns ctx.Err() if ctx is done before the reply arrives,
+// rather than blocking on mc.Receive() forever - exactly the case a
+// half-open socket produces.
+func DefaultTestOnBorrow(ctx context.Context, mc *memcached.Client, idleSince time.Time) error {
+	if err := mc.Transmit(&gomemcached.MCRequest{Opcode: gomemcached.NOOP}); err != nil {
+		return err
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		_, err := mc.Receive()
+		ch <- err
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cp *connectionPool) testOnBorrowIdle() time.Duration {
+	if cp.TestOnBorrowIdle > 0 {
+		return cp.TestOnBorrowIdle
+	}
+	return defaultTestOnBorrowIdle
+}
+
+func (cp *connectionPool) testOnBorrowTimeout() time.Duration {
+	if cp.TestOnBorrowTimeout > 0 {
+		return cp.TestOnBorrowTimeout
+	}
+	return defaultTestOnBorrowTimeout
+}
+
 func (cp *connectionPool) GetWithTimeout(d time.Duration) (*memcached.Client, error) {
 	if cp == nil {
 		return nil, errors.New("no pool")
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	rv, err := cp.GetWithContext(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, TimeoutError
+	}
+	return rv, err
+}
+
+// GetWithContext is like GetWithTimeout, but stops waiting as soon as
+// ctx is done, rather than on a fixed duration, and abandons an
+// in-flight dial rather than handing back a connection the caller no
+// longer wants. mkConn's signature has no ctx of its own, so the dial
+// itself (the underlying network connect) is not actually interrupted;
+// it keeps running in the background and whatever it eventually
+// produces gets closed unused. This still lets callers propagate
+// cancellation from an inbound request instead of guessing a timeout
+// up front, and it frees the createsem slot promptly either way.
+func (cp *connectionPool) GetWithContext(ctx context.Context) (*memcached.Client, error) {
+	if cp == nil {
+		return nil, errors.New("no pool")
+	}
+
+	atomic.AddUint64(&cp.statGets, 1)
+	cp.startReaper()
+
+	for {
+		pc, err := cp.getPooledWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		if cp.expired(pc, now) {
+			cp.discard(pc)
+			continue
+		}
+		if cp.TestOnBorrow != nil && now.Sub(pc.timeUsed) > cp.testOnBorrowIdle() {
+			probeCtx, cancel := context.WithTimeout(ctx, cp.testOnBorrowTimeout())
+			err := cp.TestOnBorrow(probeCtx, pc.conn, pc.timeUsed)
+			cancel()
+			if err != nil {
+				cp.discard(pc)
+				continue
+			}
+		}
+		return pc.conn, nil
+	}
+}
+
+func (cp *connectionPool) getPooledWithContext(ctx context.Context) (*pooledConn, error) {
 	t := time.NewTimer(time.Millisecond)
 	defer t.Stop()
 
 	select {
-	case rv, isopen := <-cp.connections:
+	case pc, isopen := <-cp.connections:
 		if !isopen {
 			return nil, closedPool
 		}
-		return rv, nil
+		return pc, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-t.C:
-		t.Reset(d) // Reuse the timer for the full timeout.
+		waitStart := time.Now()
+		atomic.AddUint64(&cp.statWaits, 1)
+		defer func() {
+			atomic.AddUint64(&cp.statWaitNanos, uint64(time.Since(waitStart)))
+		}()
+
 		select {
-		case rv, isopen := <-cp.connections:
+		case pc, isopen := <-cp.connections:
 			if !isopen {
 				return nil, closedPool
 			}
-			return rv, nil
+			return pc, nil
 		case cp.createsem <- true:
 			// Build a connection if we can't get a real one.
 			// This can potentially be an overflow connection, or
 			// a pooled connection.
-			rv, err := cp.mkConn(cp.host, cp.auth)
+			if err := cp.breakerGate(); err != nil {
+				<-cp.createsem
+				return nil, err
+			}
+			conn, err := cp.mkConnWithContext(ctx)
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				// The caller gave up waiting; this says nothing
+				// about whether the host is reachable, so don't
+				// let it trip or extend the breaker.
+				cp.breakerRelease()
+			} else {
+				cp.breakerRecord(err)
+			}
 			if err != nil {
 				// On error, release our create hold
 				<-cp.createsem
+				if err != context.Canceled && err != context.DeadlineExceeded {
+					atomic.AddUint64(&cp.statDialErrors, 1)
+				}
+				return nil, err
 			}
-			return rv, err
-		case <-t.C:
-			return nil, TimeoutError
+			now := time.Now()
+			pc := &pooledConn{conn: conn, timeInitiated: now, timeUsed: now}
+			cp.mu.Lock()
+			cp.metadata[conn] = pc
+			cp.mu.Unlock()
+			return pc, nil
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				atomic.AddUint64(&cp.statTimeouts, 1)
+			}
+			return nil, ctx.Err()
 		}
 	}
 }
 
+// mkConnWithContext dials through cp.mkConn on a goroutine so that a
+// cancelled ctx returns promptly instead of blocking on the dial. If
+// ctx fires before the dial completes, mkConnWithContext returns
+// immediately (leaving the caller to release its createsem hold) and
+// any connection that eventually arrives is closed rather than handed
+// back.
+func (cp *connectionPool) mkConnWithContext(ctx context.Context) (*memcached.Client, error) {
+	type dialResult struct {
+		conn *memcached.Client
+		err  error
+	}
+
+	ch := make(chan dialResult, 1)
+	go func() {
+		conn, err := cp.mkConn(cp.host, cp.auth)
+		ch <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
 func (cp *connectionPool) Get() (*memcached.Client, error) {
 	return cp.GetWithTimeout(ConnPoolTimeout)
 }
@@ -104,7 +678,18 @@ func (cp *connectionPool) Return(c *memcached.Client) {
 		return
 	}
 
+	cp.mu.Lock()
+	pc, found := cp.metadata[c]
+	cp.mu.Unlock()
+	if !found {
+		// Not a connection this pool minted (e.g. already discarded);
+		// just close it.
+		c.Close()
+		return
+	}
+
 	if c.IsHealthy() {
+		pc.timeUsed = time.Now()
 		defer func() {
 			if recover() != nil {
 				// This happens when the pool has already been
@@ -116,15 +701,15 @@ func (cp *connectionPool) Return(c *memcached.Client) {
 		}()
 
 		select {
-		case cp.connections <- c:
+		case cp.connections <- pc:
+			atomic.AddUint64(&cp.statReturned, 1)
 		default:
 			// Overflow connection.
-			<-cp.createsem
-			c.Close()
+			atomic.AddUint64(&cp.statOverflows, 1)
+			cp.discard(pc)
 		}
 	} else {
-		<-cp.createsem
-		c.Close()
+		cp.discard(pc)
 	}
 }
 
@@ -140,6 +725,9 @@ func (cp *connectionPool) StartTapFeed(args *memcached.TapArguments) (*memcached
 	// A connection can't be used after TAP; Dont' count it against the
 	// connection pool capacity
 	<-cp.createsem
+	cp.mu.Lock()
+	delete(cp.metadata, mc)
+	cp.mu.Unlock()
 
 	return mc.StartTapFeed(*args)
 }
@@ -0,0 +1,371 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached/client"
+)
+
+// newTestListener starts a bare TCP listener and returns the dialed
+// connections it accepts, for tests that need a real *memcached.Client
+// (constructing one by hand, e.g. &memcached.Client{}, risks invoking
+// its methods on a zero-value client that was never actually wired to
+// a socket).
+func newTestListener(t *testing.T) (addr string, accepted chan net.Conn, cleanup func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ch := make(chan net.Conn, 16)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ch <- c
+		}
+	}()
+	return ln.Addr().String(), ch, func() { ln.Close() }
+}
+
+type fakeAuthHandler struct{}
+
+func (fakeAuthHandler) GetCredentials() (string, string) {
+	return "default", ""
+}
+
+// TestGetWithContextCancelReleasesCreatesem guards against a cancelled
+// caller leaving its createsem slot held: the dial it started keeps
+// running in the background (mkConn has no ctx of its own to abort
+// it), but GetWithContext must still give up the slot promptly rather
+// than wait for that abandoned dial to finish.
+func TestGetWithContextCancelReleasesCreatesem(t *testing.T) {
+	cp := newConnectionPool("ignored", fakeAuthHandler{}, 1, 0)
+
+	release := make(chan struct{})
+	cp.mkConn = func(host string, ah AuthHandler) (*memcached.Client, error) {
+		<-release
+		return nil, errors.New("dial abandoned before it could complete")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := cp.GetWithContext(ctx)
+		errCh <- err
+	}()
+
+	// Give the goroutine time to take the createsem slot and start the
+	// (stubbed) dial before we cancel.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("GetWithContext = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetWithContext did not return after ctx was cancelled")
+	}
+
+	select {
+	case cp.createsem <- true:
+		<-cp.createsem
+	default:
+		t.Fatal("createsem slot was not released promptly on context cancellation")
+	}
+
+	close(release)
+}
+
+// TestOnBorrowDiscardsStaleConnection checks that a TestOnBorrow
+// failure on checkout discards the stale connection and transparently
+// redials, rather than handing the caller a connection already known
+// to be bad.
+func TestOnBorrowDiscardsStaleConnection(t *testing.T) {
+	addr, accepted, cleanup := newTestListener(t)
+	defer cleanup()
+
+	cp := newConnectionPool(addr, fakeAuthHandler{}, 1, 0)
+
+	first, err := cp.GetWithContext(context.Background())
+	if err != nil {
+		t.Fatalf("first Get: %v", err)
+	}
+	<-accepted
+	cp.Return(first)
+
+	// Arm the health check only now, so it fires on the checkout below
+	// rather than on the dial that just happened.
+	cp.TestOnBorrowIdle = time.Nanosecond
+	var calls int32
+	checked := make(chan struct{}, 2)
+	cp.TestOnBorrow = func(ctx context.Context, mc *memcached.Client, idleSince time.Time) error {
+		checked <- struct{}{}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("connection is stale")
+		}
+		return nil
+	}
+
+	second, err := cp.GetWithContext(context.Background())
+	if err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+	<-accepted // the stale connection was discarded and redialed
+
+	select {
+	case <-checked:
+	default:
+		t.Fatal("TestOnBorrow was not invoked on checkout")
+	}
+	if second == first {
+		t.Fatal("a connection that failed TestOnBorrow should have been discarded and redialed, not reused")
+	}
+	if got := cp.Stats().Discarded; got == 0 {
+		t.Fatalf("Discarded = %d, want > 0", got)
+	}
+}
+
+// TestCloseWaitsForReaper guards against the race where Close() closed
+// cp.connections out from under a reaper() goroutine still mid-tick,
+// which could panic on a nil pooledConn or a send on a closed channel.
+// Close() must not return until the reaper has fully stopped.
+func TestCloseWaitsForReaper(t *testing.T) {
+	orig := reapInterval
+	reapInterval = time.Millisecond
+	defer func() { reapInterval = orig }()
+
+	cp := newConnectionPool("example.com:11211", fakeAuthHandler{}, 1, 0)
+	// IdleTimeout is configured before the reaper ever starts reading
+	// it: startReaper (called from GetWithContext, and here directly so
+	// the reaper is already ticking before Close, as it would be after a
+	// first Get) only spins up the goroutine once, so there's no window
+	// where it observes this field concurrently with the write below.
+	cp.IdleTimeout = time.Nanosecond
+	cp.startReaper()
+
+	// Give the reaper a chance to be in the middle of a tick.
+	time.Sleep(5 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		cp.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	select {
+	case <-cp.reapDone:
+	default:
+		t.Fatal("Close returned before the reaper goroutine had exited")
+	}
+}
+
+// TestCircuitBreakerLifecycle walks a breaker through trip, probe,
+// failed-probe backoff and recovery, and guards against the specific
+// regression where a failed IO report against an already-open breaker
+// re-tripped it and reset its cooldown back to the base value.
+func TestCircuitBreakerLifecycle(t *testing.T) {
+	cp := &connectionPool{
+		BreakerThreshold:   2,
+		BreakerCooldown:    20 * time.Millisecond,
+		BreakerMaxCooldown: 200 * time.Millisecond,
+	}
+
+	if err := cp.breakerGate(); err != nil {
+		t.Fatalf("closed breaker should allow dials, got %v", err)
+	}
+
+	cp.breakerRecord(errors.New("dial failed"))
+	if cp.breaker.open {
+		t.Fatal("breaker should not trip before BreakerThreshold failures")
+	}
+
+	cp.breakerRecord(errors.New("dial failed"))
+	if !cp.breaker.open {
+		t.Fatal("breaker should trip once BreakerThreshold failures are reached")
+	}
+	if got := cp.BreakerStats().Trips; got != 1 {
+		t.Fatalf("Trips = %d, want 1", got)
+	}
+
+	if err := cp.breakerGate(); err != ErrCircuitOpen {
+		t.Fatalf("gate should fail fast while open and cooling down, got %v", err)
+	}
+
+	cooldownBefore := cp.breaker.cooldown
+	openUntilBefore := cp.breaker.openUntil
+	cp.ReportIOResult(errors.New("kv op failed over a connection checked out before the trip"))
+	if got := cp.BreakerStats().Trips; got != 1 {
+		t.Fatalf("a failed IO report against an already-open breaker must not retrip it; Trips = %d, want 1", got)
+	}
+	if cp.breaker.cooldown != cooldownBefore || cp.breaker.openUntil != openUntilBefore {
+		t.Fatal("a failed IO report against an already-open breaker must not reset its cooldown")
+	}
+
+	time.Sleep(cp.breaker.cooldown + 5*time.Millisecond)
+
+	if err := cp.breakerGate(); err != nil {
+		t.Fatalf("expected a single probe through after cooldown, got %v", err)
+	}
+	if err := cp.breakerGate(); err != ErrCircuitOpen {
+		t.Fatalf("a second concurrent gate attempt must not also get a probe, got %v", err)
+	}
+
+	cp.breakerRecord(errors.New("probe failed"))
+	if !cp.breaker.open {
+		t.Fatal("breaker should remain open after a failed probe")
+	}
+	if cp.breaker.cooldown <= cooldownBefore {
+		t.Fatalf("cooldown should grow after a failed probe: got %v, want > %v", cp.breaker.cooldown, cooldownBefore)
+	}
+
+	// openUntil carries up to +20% jitter on top of the doubled cooldown.
+	time.Sleep(time.Until(cp.breaker.openUntil) + 5*time.Millisecond)
+
+	if err := cp.breakerGate(); err != nil {
+		t.Fatalf("expected a probe through after the extended cooldown, got %v", err)
+	}
+	cp.breakerRecord(nil)
+	if cp.breaker.open {
+		t.Fatal("breaker should close after a successful probe")
+	}
+	if got := cp.BreakerStats().Successes; got != 1 {
+		t.Fatalf("Successes = %d, want 1", got)
+	}
+}
+
+// TestBreakerReleaseIgnoresCancellation guards against a caller's
+// context expiring mid-dial being fed into the breaker as if it were a
+// real dial failure: an abandoned attempt must not count against
+// BreakerThreshold.
+func TestBreakerReleaseIgnoresCancellation(t *testing.T) {
+	cp := &connectionPool{BreakerThreshold: 1}
+
+	if err := cp.breakerGate(); err != nil {
+		t.Fatalf("closed breaker should allow dials, got %v", err)
+	}
+	cp.breakerRelease()
+
+	if cp.breaker.probing {
+		t.Fatal("breakerRelease should clear the probe flag")
+	}
+	if cp.breaker.failures != 0 || cp.breaker.open {
+		t.Fatal("an abandoned (cancelled) attempt must not count as a failure")
+	}
+}
+
+// TestStatsGetsAndGauges checks that Gets, Returned and the Idle/InUse
+// gauges move the way Stats is documented to as a connection is
+// checked out and returned.
+func TestStatsGetsAndGauges(t *testing.T) {
+	addr, accepted, cleanup := newTestListener(t)
+	defer cleanup()
+
+	cp := newConnectionPool(addr, fakeAuthHandler{}, 2, 0)
+
+	c1, err := cp.GetWithContext(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	<-accepted
+
+	if got := cp.Stats().Gets; got != 1 {
+		t.Fatalf("Gets = %d, want 1", got)
+	}
+	if s := cp.Stats(); s.Idle != 0 || s.InUse != 1 {
+		t.Fatalf("Idle=%d InUse=%d, want 0,1", s.Idle, s.InUse)
+	}
+
+	cp.Return(c1)
+	if s := cp.Stats(); s.Idle != 1 || s.InUse != 0 {
+		t.Fatalf("Idle=%d InUse=%d, want 1,0", s.Idle, s.InUse)
+	}
+	if got := cp.Stats().Returned; got != 1 {
+		t.Fatalf("Returned = %d, want 1", got)
+	}
+}
+
+// TestStatsOverflowAndDiscarded checks that returning more connections
+// than poolSize allows counts as an overflow and discards the extra
+// connection, per Stats' documented Overflows/Discarded counters.
+func TestStatsOverflowAndDiscarded(t *testing.T) {
+	addr, accepted, cleanup := newTestListener(t)
+	defer cleanup()
+
+	cp := newConnectionPool(addr, fakeAuthHandler{}, 1, 1)
+
+	c1, err := cp.GetWithContext(context.Background())
+	if err != nil {
+		t.Fatalf("Get 1: %v", err)
+	}
+	<-accepted
+	c2, err := cp.GetWithContext(context.Background())
+	if err != nil {
+		t.Fatalf("Get 2: %v", err)
+	}
+	<-accepted
+
+	cp.Return(c1) // fills the size-1 connections buffer
+	cp.Return(c2) // buffer is full: counts as overflow and is discarded
+
+	stats := cp.Stats()
+	if stats.Overflows != 1 {
+		t.Fatalf("Overflows = %d, want 1", stats.Overflows)
+	}
+	if stats.Discarded != 1 {
+		t.Fatalf("Discarded = %d, want 1", stats.Discarded)
+	}
+	if stats.Idle != 1 || stats.InUse != 0 {
+		t.Fatalf("Idle=%d InUse=%d, want 1,0", stats.Idle, stats.InUse)
+	}
+}
+
+// TestStatsWaitsAndTimeouts checks that a Get against an exhausted
+// pool counts as a Wait, and that one which can't be satisfied before
+// its context expires counts as a Timeout and surfaces TimeoutError.
+func TestStatsWaitsAndTimeouts(t *testing.T) {
+	addr, accepted, cleanup := newTestListener(t)
+	defer cleanup()
+
+	cp := newConnectionPool(addr, fakeAuthHandler{}, 1, 0)
+
+	c1, err := cp.GetWithContext(context.Background())
+	if err != nil {
+		t.Fatalf("Get 1: %v", err)
+	}
+	<-accepted
+
+	// Nothing idle and no overflow room left, so this Get must wait
+	// past the initial grace period and then time out.
+	if _, err := cp.GetWithTimeout(5 * time.Millisecond); err != TimeoutError {
+		t.Fatalf("GetWithTimeout = %v, want TimeoutError", err)
+	}
+
+	stats := cp.Stats()
+	if stats.Waits == 0 {
+		t.Fatalf("Waits = %d, want > 0", stats.Waits)
+	}
+	if stats.Timeouts != 1 {
+		t.Fatalf("Timeouts = %d, want 1", stats.Timeouts)
+	}
+	if stats.WaitDuration <= 0 {
+		t.Fatalf("WaitDuration = %v, want > 0", stats.WaitDuration)
+	}
+
+	cp.Return(c1)
+}